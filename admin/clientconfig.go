@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mjl-/mox/dns"
+)
+
+// TLSMode describes how a service expects TLS to be negotiated.
+type TLSMode int
+
+const (
+	TLSModeImmediate TLSMode = iota // Implicit TLS, e.g. IMAPS, submissions.
+	TLSModeSTARTTLS
+	TLSModeNone
+)
+
+// ServerConfig is the host/port/TLS triple for a single service (IMAP,
+// submission, POP3) as advertised to mail clients.
+type ServerConfig struct {
+	Host           dns.Domain
+	Port           int
+	TLSMode        TLSMode
+	EnabledOnHTTPS bool // Also reachable on port 443 through ALPN/TLS SNI.
+}
+
+// OAuth2Config holds the endpoints a mail client needs to run an OAuth2 flow
+// against this mox instance, advertised through autoconfig's <oauth2> block.
+type OAuth2Config struct {
+	Issuer           string
+	Scope            string
+	AuthorizationURL string
+	TokenURL         string
+}
+
+// ClientAuth holds the per-domain authentication mechanisms to advertise to
+// mail clients through autoconfig/autodiscover/mobileconfig.
+type ClientAuth struct {
+	PreferClientCert  bool
+	RequireClientCert bool
+	AllowCleartext    bool
+	OAuth2            *OAuth2Config
+
+	// ClientCertPKCS12 holds a PKCS#12 bundle (certificate, key and chain) to
+	// embed in generated .mobileconfig profiles so client-cert auth works out of
+	// the box on Apple devices.
+	ClientCertPKCS12 []byte
+}
+
+// ClientConfig is the per-domain configuration consumed by the
+// autoconfig/autodiscover/mobileconfig endpoints in the http package.
+type ClientConfig struct {
+	IMAP       ServerConfig
+	Submission ServerConfig
+	POP3       ServerConfig
+
+	// RedirectAddr, if set, tells autodiscover v2 clients that mail for this
+	// domain is actually served elsewhere, and to retry autodiscovery against
+	// this hostname instead of returning protocol-specific settings.
+	RedirectAddr string
+
+	Auth ClientAuth
+}
+
+var (
+	clientConfigsMu sync.Mutex
+	clientConfigs   = map[string]ClientConfig{}
+)
+
+// SetClientConfig registers (or replaces) the client configuration for
+// domain, called from the admin API/config loader when a domain is added or
+// its mail client settings change.
+func SetClientConfig(domain dns.Domain, config ClientConfig) {
+	clientConfigsMu.Lock()
+	defer clientConfigsMu.Unlock()
+	clientConfigs[domain.ASCII] = config
+}
+
+// RemoveClientConfig forgets the client configuration for domain.
+func RemoveClientConfig(domain dns.Domain) {
+	clientConfigsMu.Lock()
+	defer clientConfigsMu.Unlock()
+	delete(clientConfigs, domain.ASCII)
+}
+
+// ClientConfigDomain returns the client configuration for domain, as
+// registered through SetClientConfig. It returns an error for domains mox
+// doesn't host, which callers also use to tell a known domain apart from
+// scan/probe traffic, see the http package's autoconfig caching.
+func ClientConfigDomain(domain dns.Domain) (ClientConfig, error) {
+	clientConfigsMu.Lock()
+	defer clientConfigsMu.Unlock()
+	config, ok := clientConfigs[domain.ASCII]
+	if !ok {
+		return ClientConfig{}, fmt.Errorf("domain %s not configured", domain.ASCII)
+	}
+	return config, nil
+}
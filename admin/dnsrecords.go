@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mjl-/mox/dns"
+)
+
+// wantSRV is a single SRV record DNSRecords recommends, kept structured (not
+// just the rendered zonefile line) so DNSRecordsCheckDrift can look up and
+// compare the exact same record instead of re-parsing free-form text.
+type wantSRV struct {
+	service      string
+	prio, weight int
+	port         int
+	target       string
+}
+
+// dnsWant collects the records DNSRecords recommends for a domain, both as
+// zonefile lines (for the admin UI to display/copy) and structured (for
+// DNSRecordsCheckDrift to verify against live DNS).
+type dnsWant struct {
+	srv    []wantSRV
+	cnames map[string]string // name (without trailing dot) -> target
+	txt    string
+}
+
+func dnsRecordsWant(domain dns.Domain, config ClientConfig) dnsWant {
+	host := domain.ASCII
+	var w dnsWant
+	w.cnames = map[string]string{}
+
+	addSRV := func(service string, prio, weight, port int, target string) {
+		w.srv = append(w.srv, wantSRV{service, prio, weight, port, target})
+	}
+
+	// Only advertise implicit-TLS SRV records for services actually configured
+	// for implicit TLS: a client that follows the SRV record to a STARTTLS-only
+	// port would otherwise fail to connect securely.
+	if config.IMAP.Host.ASCII != "" && config.IMAP.TLSMode == TLSModeImmediate {
+		addSRV("imaps", 0, 1, config.IMAP.Port, config.IMAP.Host.ASCII)
+	}
+	if config.Submission.Host.ASCII != "" {
+		// RFC 8314 recommends implicit TLS, priority 0, over STARTTLS, priority 1.
+		if config.Submission.TLSMode == TLSModeImmediate {
+			addSRV("submissions", 0, 1, config.Submission.Port, config.Submission.Host.ASCII)
+		}
+		if config.Submission.TLSMode == TLSModeSTARTTLS {
+			addSRV("submission", 1, 1, config.Submission.Port, config.Submission.Host.ASCII)
+		}
+	}
+	if config.POP3.Host.ASCII != "" && config.POP3.TLSMode == TLSModeImmediate {
+		addSRV("pop3s", 0, 1, config.POP3.Port, config.POP3.Host.ASCII)
+	}
+
+	w.cnames["autoconfig."+host] = host
+	w.cnames["autodiscover."+host] = host
+	w.txt = fmt.Sprintf("mailconf=https://autoconfig.%s/mail/config-v1.1.xml", host)
+
+	return w
+}
+
+// DNSRecords returns the recommended DNS records for domain's mail services as
+// zonefile snippets, ready to paste into a zone: RFC 6186/8314 SRV records for
+// IMAPS, submission(s) and (if enabled) POP3S, autoconfig/autodiscover CNAMEs,
+// and the "mailconf=" TXT hint so autoconfig clients can go straight to our
+// config document instead of probing autoconfig.<domain> first. SRV records
+// are only emitted for services actually configured for the TLS mode they
+// imply, see dnsRecordsWant. The admin web UI renders these per domain so
+// operators can copy-paste them.
+//
+// See https://www.rfc-editor.org/rfc/rfc6186 and
+// https://www.rfc-editor.org/rfc/rfc8314.
+func DNSRecords(domain dns.Domain, config ClientConfig) []string {
+	w := dnsRecordsWant(domain, config)
+	host := domain.ASCII
+
+	var lines []string
+	for _, s := range w.srv {
+		lines = append(lines, fmt.Sprintf("_%s._tcp.%s.\tIN\tSRV\t%d %d %d\t%s.", s.service, host, s.prio, s.weight, s.port, s.target))
+	}
+	lines = append(lines,
+		fmt.Sprintf("autoconfig.%s.\tIN\tCNAME\t%s.", host, host),
+		fmt.Sprintf("autodiscover.%s.\tIN\tCNAME\t%s.", host, host),
+		fmt.Sprintf("%s.\tIN\tTXT\t\"%s\"", host, w.txt),
+	)
+	return lines
+}
+
+// DNSRecordsCheckDrift looks up the records DNSRecords recommends for domain
+// using resolver, and reports which are missing or don't match, for the
+// admin UI's "check DNS records" mode (see the domain page's DNS records
+// check, which calls this after rendering DNSRecords).
+func DNSRecordsCheckDrift(ctx context.Context, resolver dns.Resolver, domain dns.Domain, config ClientConfig) (remarks []string, err error) {
+	w := dnsRecordsWant(domain, config)
+
+	for _, want := range w.srv {
+		_, addrs, lerr := resolver.LookupSRV(ctx, want.service, "tcp", domain.ASCII)
+		if lerr != nil {
+			remarks = append(remarks, fmt.Sprintf("looking up SRV record _%s._tcp.%s: %v", want.service, domain.ASCII, lerr))
+			continue
+		}
+		var found bool
+		for _, a := range addrs {
+			if strings.TrimSuffix(a.Target, ".") == want.target && int(a.Port) == want.port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remarks = append(remarks, fmt.Sprintf("SRV record _%s._tcp.%s does not point at %s:%d as recommended", want.service, domain.ASCII, want.target, want.port))
+		}
+	}
+
+	for name, target := range w.cnames {
+		cname, lerr := resolver.LookupCNAME(ctx, name+".")
+		if lerr != nil {
+			remarks = append(remarks, fmt.Sprintf("looking up CNAME record %s: %v", name, lerr))
+			continue
+		}
+		if strings.TrimSuffix(cname, ".") != target {
+			remarks = append(remarks, fmt.Sprintf("CNAME record %s points at %s instead of %s", name, strings.TrimSuffix(cname, "."), target))
+		}
+	}
+
+	txts, lerr := resolver.LookupTXT(ctx, domain.ASCII+".")
+	if lerr != nil {
+		remarks = append(remarks, fmt.Sprintf("looking up TXT records for %s: %v", domain.ASCII, lerr))
+	} else {
+		var found bool
+		for _, t := range txts {
+			if t == w.txt {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remarks = append(remarks, fmt.Sprintf("no TXT record %q found for %s", w.txt, domain.ASCII))
+		}
+	}
+
+	return remarks, nil
+}
@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sync"
+
+	"github.com/mjl-/mox/dns"
+)
+
+// mobileConfigSigner holds the CMS/PKCS#7 signer material configured for a
+// domain's generated .mobileconfig profiles: the signer's certificate+key
+// and, optionally, an intermediate chain to embed alongside it.
+type mobileConfigSigner struct {
+	cert  tls.Certificate
+	chain []*x509.Certificate
+}
+
+var (
+	mobileConfigSignersMu sync.Mutex
+	mobileConfigSigners   = map[string]mobileConfigSigner{}
+)
+
+// SetMobileConfigSigner configures the CMS/PKCS#7 signer used to sign
+// .mobileconfig profiles for domain. This is the admin API surface operators
+// use to point autoconfig at their ACME-issued certificate: certPEM/keyPEM
+// are the signer's certificate and private key, chainPEM is an optional
+// concatenation of PEM-encoded intermediate certificates to include in the
+// signed-data structure alongside the signer cert.
+func SetMobileConfigSigner(domain dns.Domain, certPEM, keyPEM, chainPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("parsing signer certificate/key: %v", err)
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parsing signer leaf certificate: %v", err)
+		}
+		cert.Leaf = leaf
+	}
+
+	var chain []*x509.Certificate
+	rest := chainPEM
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("parsing intermediate certificate: %v", err)
+		}
+		chain = append(chain, c)
+	}
+
+	mobileConfigSignersMu.Lock()
+	defer mobileConfigSignersMu.Unlock()
+	mobileConfigSigners[domain.ASCII] = mobileConfigSigner{cert, chain}
+	return nil
+}
+
+// RemoveMobileConfigSigner clears the signer configured for domain, so
+// .mobileconfig profiles for it go back to being served unsigned.
+func RemoveMobileConfigSigner(domain dns.Domain) {
+	mobileConfigSignersMu.Lock()
+	defer mobileConfigSignersMu.Unlock()
+	delete(mobileConfigSigners, domain.ASCII)
+}
+
+// MobileConfigSigner returns the signer configured for domain, if any. ok is
+// false, with a zero error, when no signer is configured, which callers use
+// to fall back to an unsigned profile.
+func MobileConfigSigner(domain dns.Domain) (cert tls.Certificate, chain []*x509.Certificate, ok bool, err error) {
+	mobileConfigSignersMu.Lock()
+	defer mobileConfigSignersMu.Unlock()
+	s, ok := mobileConfigSigners[domain.ASCII]
+	if !ok {
+		return tls.Certificate{}, nil, false, nil
+	}
+	return s.cert, s.chain, true, nil
+}
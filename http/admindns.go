@@ -0,0 +1,49 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mjl-/mox/admin"
+	"github.com/mjl-/mox/dns"
+)
+
+// adminDNSRecordsHandle serves the recommended DNS records for a domain, and,
+// with ?check=1, compares them against live DNS. This backs the domain page's
+// "DNS records"/"check DNS records" admin UI.
+func adminDNSRecordsHandle(w http.ResponseWriter, r *http.Request) {
+	log := pkglog.WithContext(r.Context())
+
+	if r.Method != "GET" {
+		http.Error(w, "405 - method not allowed - get required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	domain, err := dns.ParseDomain(r.FormValue("domain"))
+	if err != nil {
+		http.Error(w, "400 - bad request - invalid parameter domain", http.StatusBadRequest)
+		return
+	}
+	config, err := admin.ClientConfigDomain(domain)
+	if err != nil {
+		http.Error(w, "400 - bad request - "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := struct {
+		Records []string
+		Remarks []string `json:",omitempty"`
+	}{Records: admin.DNSRecords(domain, config)}
+
+	if r.FormValue("check") == "1" {
+		resp.Remarks, err = admin.DNSRecordsCheckDrift(r.Context(), dns.DefaultResolver(), domain, config)
+		if err != nil {
+			http.Error(w, "500 - internal server error - "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err = json.NewEncoder(w).Encode(resp)
+	log.Check(err, "write dns records response")
+}
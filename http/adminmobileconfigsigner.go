@@ -0,0 +1,47 @@
+package http
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/mjl-/mox/admin"
+	"github.com/mjl-/mox/dns"
+)
+
+// adminMobileConfigSignerHandle lets an operator configure (POST) or clear
+// (DELETE) the CMS/PKCS#7 signer used to sign .mobileconfig profiles for a
+// domain, e.g. pointing it at their ACME-issued certificate. This backs the
+// domain page's "mobileconfig signing certificate" admin UI.
+func adminMobileConfigSignerHandle(w http.ResponseWriter, r *http.Request) {
+	log := pkglog.WithContext(r.Context())
+
+	domain, err := dns.ParseDomain(r.FormValue("domain"))
+	if err != nil {
+		http.Error(w, "400 - bad request - invalid parameter domain", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		certPEM := []byte(r.FormValue("cert"))
+		keyPEM := []byte(r.FormValue("key"))
+		chainPEM := []byte(r.FormValue("chain"))
+		if len(certPEM) == 0 || len(keyPEM) == 0 {
+			http.Error(w, "400 - bad request - missing cert or key", http.StatusBadRequest)
+			return
+		}
+		if err := admin.SetMobileConfigSigner(domain, certPEM, keyPEM, chainPEM); err != nil {
+			http.Error(w, fmt.Sprintf("400 - bad request - %s", err), http.StatusBadRequest)
+			return
+		}
+	case "DELETE":
+		admin.RemoveMobileConfigSigner(domain)
+	default:
+		http.Error(w, "405 - method not allowed - post or delete required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	log.Debug("mobileconfig signer updated", slog.String("domain", domain.ASCII), slog.String("method", r.Method))
+}
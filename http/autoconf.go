@@ -1,6 +1,7 @@
 package http
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"log/slog"
@@ -36,7 +37,9 @@ var (
 // Autoconfiguration/Autodiscovery:
 //
 //   - Thunderbird will request an "autoconfig" xml file.
-//   - Microsoft tools will request an "autodiscovery" xml file.
+//   - Microsoft tools will request an "autodiscovery" xml file, though modern
+//     Outlook clients (Windows/Mac/mobile) use the JSON-based "autodiscover v2"
+//     protocol instead, see autodiscoverV2Handle.
 //   - In my tests on an internal domain, iOS mail only talks to Apple servers, then
 //     does not attempt autoconfiguration. Possibly due to them being private DNS
 //     names. Apple software can be provisioned with "mobileconfig" profile files,
@@ -87,30 +90,50 @@ func autoconfHandle(w http.ResponseWriter, r *http.Request) {
 		domain = addr.Domain
 	}
 
-	socketType := func(tlsMode admin.TLSMode) (string, error) {
-		switch tlsMode {
-		case admin.TLSModeImmediate:
-			return "SSL", nil
-		case admin.TLSModeSTARTTLS:
-			return "STARTTLS", nil
-		case admin.TLSModeNone:
-			return "plain", nil
-		default:
-			return "", fmt.Errorf("unknown tls mode %v", tlsMode)
-		}
+	addrDom = metricDomainLabel(domain)
+
+	// The rendered body bakes in email (display name, incoming/outgoing
+	// usernames), so it must be part of the cache key: two users on the same
+	// domain must never see each other's cached response.
+	err := serveCachedResponse(w, r, "autoconf:"+domain.ASCII+":"+strings.ToLower(email), "application/xml; charset=utf-8", func() ([]byte, error) {
+		return renderAutoconf(r, domain, email)
+	})
+	log.Check(err, "write autoconfig xml response")
+}
+
+// autoconfSocketType returns the autoconfig "socketType" value for tlsMode.
+func autoconfSocketType(tlsMode admin.TLSMode) (string, error) {
+	switch tlsMode {
+	case admin.TLSModeImmediate:
+		return "SSL", nil
+	case admin.TLSModeSTARTTLS:
+		return "STARTTLS", nil
+	case admin.TLSModeNone:
+		return "plain", nil
+	default:
+		return "", fmt.Errorf("unknown tls mode %v", tlsMode)
 	}
+}
+
+// renderAutoconf builds the autoconfig XML body for domain/email. Only
+// called on a cache miss; see serveCachedResponse.
+func renderAutoconf(r *http.Request, domain dns.Domain, email string) ([]byte, error) {
+	socketType := autoconfSocketType
 
-	var imapTLS, submissionTLS string
 	config, err := admin.ClientConfigDomain(domain)
-	if err == nil {
-		imapTLS, err = socketType(config.IMAP.TLSMode)
+	if err != nil {
+		if !allowUnknownDomainLookup(r) {
+			return nil, errTooManyUnknownDomainLookups
+		}
+		return nil, err
 	}
-	if err == nil {
-		submissionTLS, err = socketType(config.Submission.TLSMode)
+	imapTLS, err := socketType(config.IMAP.TLSMode)
+	if err != nil {
+		return nil, err
 	}
+	submissionTLS, err := socketType(config.Submission.TLSMode)
 	if err != nil {
-		http.Error(w, "400 - bad request - "+err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
 	// Thunderbird doesn't seem to allow U-labels, always return ASCII names.
@@ -121,62 +144,98 @@ func autoconfHandle(w http.ResponseWriter, r *http.Request) {
 	resp.EmailProvider.DisplayName = email
 	resp.EmailProvider.DisplayShortName = domain.ASCII
 
-	// todo: specify SCRAM-SHA-256 once thunderbird and autoconfig supports it. or perhaps that will fall under "password-encrypted" by then.
-	// todo: let user configure they prefer or require tls client auth and specify "TLS-client-cert"
-
-	incoming := incomingServer{
-		"imap",
-		config.IMAP.Host.ASCII,
-		config.IMAP.Port,
-		imapTLS,
-		email,
-		"password-encrypted",
-	}
-	resp.EmailProvider.IncomingServers = append(resp.EmailProvider.IncomingServers, incoming)
-	if config.IMAP.EnabledOnHTTPS {
-		tlsMode, _ := socketType(admin.TLSModeImmediate)
-		incomingALPN := incomingServer{
+	// Authentication mechanisms to advertise for this domain's auth config, in
+	// the fixed preference order of clientAuthMethods. "password-encrypted" (SCRAM-SHA-256 falls
+	// under this once Thunderbird/autoconfig support it explicitly) remains the
+	// fallback unless client-cert auth is required.
+	authMethods := clientAuthMethods(config.Auth)
+
+	for _, authMethod := range authMethods {
+		incoming := incomingServer{
 			"imap",
 			config.IMAP.Host.ASCII,
-			443,
-			tlsMode,
+			config.IMAP.Port,
+			imapTLS,
 			email,
-			"password-encrypted",
+			authMethod,
+		}
+		resp.EmailProvider.IncomingServers = append(resp.EmailProvider.IncomingServers, incoming)
+		if config.IMAP.EnabledOnHTTPS {
+			tlsMode, _ := socketType(admin.TLSModeImmediate)
+			incomingALPN := incomingServer{
+				"imap",
+				config.IMAP.Host.ASCII,
+				443,
+				tlsMode,
+				email,
+				authMethod,
+			}
+			resp.EmailProvider.IncomingServers = append(resp.EmailProvider.IncomingServers, incomingALPN)
 		}
-		resp.EmailProvider.IncomingServers = append(resp.EmailProvider.IncomingServers, incomingALPN)
-	}
 
-	outgoing := outgoingServer{
-		"smtp",
-		config.Submission.Host.ASCII,
-		config.Submission.Port,
-		submissionTLS,
-		email,
-		"password-encrypted",
-	}
-	resp.EmailProvider.OutgoingServers = append(resp.EmailProvider.OutgoingServers, outgoing)
-	if config.Submission.EnabledOnHTTPS {
-		tlsMode, _ := socketType(admin.TLSModeImmediate)
-		outgoingALPN := outgoingServer{
+		outgoing := outgoingServer{
 			"smtp",
 			config.Submission.Host.ASCII,
-			443,
-			tlsMode,
+			config.Submission.Port,
+			submissionTLS,
 			email,
-			"password-encrypted",
+			authMethod,
+		}
+		resp.EmailProvider.OutgoingServers = append(resp.EmailProvider.OutgoingServers, outgoing)
+		if config.Submission.EnabledOnHTTPS {
+			tlsMode, _ := socketType(admin.TLSModeImmediate)
+			outgoingALPN := outgoingServer{
+				"smtp",
+				config.Submission.Host.ASCII,
+				443,
+				tlsMode,
+				email,
+				authMethod,
+			}
+			resp.EmailProvider.OutgoingServers = append(resp.EmailProvider.OutgoingServers, outgoingALPN)
+		}
+	}
+
+	// Thunderbird 115+ picks up OAuth2 details from this block instead of
+	// guessing at a provider.
+	if config.Auth.OAuth2 != nil {
+		resp.EmailProvider.OAuth2 = &oauth2Config{
+			Issuer:   config.Auth.OAuth2.Issuer,
+			Scope:    config.Auth.OAuth2.Scope,
+			AuthURL:  config.Auth.OAuth2.AuthorizationURL,
+			TokenURL: config.Auth.OAuth2.TokenURL,
 		}
-		resp.EmailProvider.OutgoingServers = append(resp.EmailProvider.OutgoingServers, outgoingALPN)
 	}
 
 	// todo: should we put the email address in the URL?
 	resp.ClientConfigUpdate.URL = fmt.Sprintf("https://autoconfig.%s/mail/config-v1.1.xml", domain.ASCII)
 
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-	enc := xml.NewEncoder(w)
+	// clientConfig v1.1 extension Thunderbird uses to provision its address book
+	// and calendar from the same account, pointing at our CalDAV/CardDAV
+	// discovery endpoints.
+	resp.AddressBook = &addressBook{
+		Type:        "carddav",
+		Name:        domain.ASCII,
+		Description: "CardDAV",
+		Username:    email,
+		ServerURL:   fmt.Sprintf("https://%s/dav/principal/", config.IMAP.Host.ASCII),
+	}
+	resp.Calendar = &calendar{
+		Type:        "caldav",
+		Name:        domain.ASCII,
+		Description: "CalDAV",
+		Username:    email,
+		ServerURL:   fmt.Sprintf("https://%s/dav/principal/", config.IMAP.Host.ASCII),
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
 	enc.Indent("", "\t")
-	fmt.Fprint(w, xml.Header)
-	err = enc.Encode(resp)
-	log.Check(err, "write autoconfig xml response")
+	if err := enc.Encode(resp); err != nil {
+		return nil, fmt.Errorf("marshal autoconfig xml response: %v", err)
+	}
+	return buf.Bytes(), nil
 }
 
 // Autodiscover from Microsoft, also used by Thunderbird.
@@ -189,6 +248,9 @@ func autoconfHandle(w http.ResponseWriter, r *http.Request) {
 // errors.
 //
 // Thunderbird does understand autodiscover.
+//
+// Modern Outlook builds mostly ignore this POX XML endpoint in favor of the
+// JSON-based autodiscover v2 protocol, see autodiscoverV2Handle.
 func autodiscoverHandle(w http.ResponseWriter, r *http.Request) {
 	log := pkglog.WithContext(r.Context())
 
@@ -215,7 +277,28 @@ func autodiscoverHandle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "400 - bad request - invalid parameter emailaddress", http.StatusBadRequest)
 		return
 	}
+	addrDom = metricDomainLabel(addr.Domain)
+
+	// Same as autoconfHandle: the rendered body bakes in the requested email
+	// address (LoginName), so the cache key must too.
+	err = serveCachedResponse(w, r, "autodiscover:"+addr.Domain.ASCII+":"+strings.ToLower(req.Request.EmailAddress), "application/xml; charset=utf-8", func() ([]byte, error) {
+		return renderAutodiscover(r, addr.Domain, req.Request.EmailAddress)
+	})
+	log.Check(err, "write autodiscover xml response")
+}
 
+// renderAutodiscover builds the autodiscover POX XML body for domain/email.
+// Only called on a cache miss; see serveCachedResponse.
+//
+// The docs are generated and fragmented in many tiny pages, hard to follow.
+// High-level starting point, https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/78530279-d042-4eb0-a1f4-03b18143cd19
+// Request: https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/2096fab2-9c3c-40b9-b123-edf6e8d55a9b
+// Response, protocol: https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/f4238db6-a983-435c-807a-b4b4a624c65b
+// It appears autodiscover does not allow specifying SCRAM-SHA-256 as
+// authentication method, or any authentication method that real clients actually
+// use. See
+// https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/21fd2dd5-c4ee-485b-94fb-e7db5da93726
+func renderAutodiscover(r *http.Request, domain dns.Domain, emailAddress string) ([]byte, error) {
 	// tlsmode returns the "ssl" and "encryption" fields.
 	tlsmode := func(tlsMode admin.TLSMode) (string, string, error) {
 		switch tlsMode {
@@ -230,32 +313,29 @@ func autodiscoverHandle(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var imapSSL, imapEncryption string
-	var submissionSSL, submissionEncryption string
-	config, err := admin.ClientConfigDomain(addr.Domain)
-	if err == nil {
-		imapSSL, imapEncryption, err = tlsmode(config.IMAP.TLSMode)
+	config, err := admin.ClientConfigDomain(domain)
+	if err != nil {
+		if !allowUnknownDomainLookup(r) {
+			return nil, errTooManyUnknownDomainLookups
+		}
+		return nil, err
 	}
-	if err == nil {
-		submissionSSL, submissionEncryption, err = tlsmode(config.Submission.TLSMode)
+	imapSSL, imapEncryption, err := tlsmode(config.IMAP.TLSMode)
+	if err != nil {
+		return nil, err
 	}
+	submissionSSL, submissionEncryption, err := tlsmode(config.Submission.TLSMode)
 	if err != nil {
-		http.Error(w, "400 - bad request - "+err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
-	// The docs are generated and fragmented in many tiny pages, hard to follow.
-	// High-level starting point, https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/78530279-d042-4eb0-a1f4-03b18143cd19
-	// Request: https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/2096fab2-9c3c-40b9-b123-edf6e8d55a9b
-	// Response, protocol: https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/f4238db6-a983-435c-807a-b4b4a624c65b
-	// It appears autodiscover does not allow specifying SCRAM-SHA-256 as
-	// authentication method, or any authentication method that real clients actually
-	// use. See
+	// AuthPackage "certificate" tells Outlook to use the client certificate
+	// installed on the device instead of prompting for a password, see
 	// https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/21fd2dd5-c4ee-485b-94fb-e7db5da93726
-
-	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
-
-	// todo: let user configure they prefer or require tls client auth and add "AuthPackage" with value "certificate" to Protocol? see https://learn.microsoft.com/en-us/openspecs/exchange_server_protocols/ms-oxdscli/21fd2dd5-c4ee-485b-94fb-e7db5da93726
+	var authPackage string
+	if config.Auth.RequireClientCert || config.Auth.PreferClientCert {
+		authPackage = "certificate"
+	}
 
 	resp := autodiscoverResponse{}
 	resp.XMLName.Local = "Autodiscover"
@@ -270,29 +350,35 @@ func autodiscoverHandle(w http.ResponseWriter, r *http.Request) {
 				Type:         "IMAP",
 				Server:       config.IMAP.Host.ASCII,
 				Port:         config.IMAP.Port,
-				LoginName:    req.Request.EmailAddress,
+				LoginName:    emailAddress,
 				SSL:          imapSSL,
 				Encryption:   imapEncryption,
 				SPA:          "off", // Override default "on", this is Microsofts proprietary authentication protocol.
 				AuthRequired: "on",
+				AuthPackage:  authPackage,
 			},
 			{
 				Type:         "SMTP",
 				Server:       config.Submission.Host.ASCII,
 				Port:         config.Submission.Port,
-				LoginName:    req.Request.EmailAddress,
+				LoginName:    emailAddress,
 				SSL:          submissionSSL,
 				Encryption:   submissionEncryption,
 				SPA:          "off", // Override default "on", this is Microsofts proprietary authentication protocol.
 				AuthRequired: "on",
+				AuthPackage:  authPackage,
 			},
 		},
 	}
-	enc := xml.NewEncoder(w)
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
 	enc.Indent("", "\t")
-	fmt.Fprint(w, xml.Header)
-	err = enc.Encode(resp)
-	log.Check(err, "marshal autodiscover xml response")
+	if err := enc.Encode(resp); err != nil {
+		return nil, fmt.Errorf("marshal autodiscover xml response: %v", err)
+	}
+	return buf.Bytes(), nil
 }
 
 // Thunderbird requests these URLs for autoconfig/autodiscover:
@@ -316,6 +402,38 @@ type outgoingServer struct {
 	Username       string `xml:"username"`
 	Authentication string `xml:"authentication"`
 }
+
+// oauth2Config is the clientConfig v1.1 extension Thunderbird 115+ reads to
+// drive its OAuth2 flow instead of guessing endpoints for a known provider.
+type oauth2Config struct {
+	Issuer   string `xml:"issuer"`
+	Scope    string `xml:"scope"`
+	AuthURL  string `xml:"authURL"`
+	TokenURL string `xml:"tokenURL"`
+}
+
+// clientAuthMethods returns the autoconfig "authentication" values to
+// advertise, in preference order, for the per-domain auth config. Required
+// client-cert auth takes over the incoming/outgoing blocks entirely, since
+// advertising a password option alongside it would defeat the point.
+func clientAuthMethods(auth admin.ClientAuth) []string {
+	if auth.RequireClientCert {
+		return []string{"TLS-client-cert"}
+	}
+	var methods []string
+	if auth.PreferClientCert {
+		methods = append(methods, "TLS-client-cert")
+	}
+	if auth.OAuth2 != nil {
+		methods = append(methods, "OAuth2")
+	}
+	methods = append(methods, "password-encrypted")
+	if auth.AllowCleartext {
+		methods = append(methods, "password-cleartext")
+	}
+	return methods
+}
+
 type autoconfigResponse struct {
 	XMLName xml.Name `xml:"clientConfig"`
 	Version string   `xml:"version,attr"`
@@ -328,11 +446,34 @@ type autoconfigResponse struct {
 
 		IncomingServers []incomingServer `xml:"incomingServer"`
 		OutgoingServers []outgoingServer `xml:"outgoingServer"`
+		OAuth2          *oauth2Config    `xml:"oauth2"`
 	} `xml:"emailProvider"`
 
 	ClientConfigUpdate struct {
 		URL string `xml:"url,attr"`
 	} `xml:"clientConfigUpdate"`
+
+	AddressBook *addressBook `xml:"addressBook"`
+	Calendar    *calendar    `xml:"calendar"`
+}
+
+// addressBook and calendar are the clientConfig v1.1 extension Thunderbird
+// uses to provision CardDAV/CalDAV accounts alongside mail.
+// See https://wiki.mozilla.org/Thunderbird:Autoconfiguration:ConfigFileFormat
+type addressBook struct {
+	Type        string `xml:"type,attr"`
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	Username    string `xml:"username"`
+	ServerURL   string `xml:"serverURL"`
+}
+
+type calendar struct {
+	Type        string `xml:"type,attr"`
+	Name        string `xml:"name"`
+	Description string `xml:"description"`
+	Username    string `xml:"username"`
+	ServerURL   string `xml:"serverURL"`
 }
 
 type autodiscoverRequest struct {
@@ -368,6 +509,7 @@ type autodiscoverProtocol struct {
 	Encryption    string `xml:",omitempty"`
 	SPA           string
 	AuthRequired  string
+	AuthPackage   string `xml:",omitempty"`
 }
 
 // Serve a .mobileconfig file. This endpoint is not a standard place where Apple
@@ -390,6 +532,13 @@ func mobileconfigHandle(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		buf, err = MobileConfig(l, fullName)
 	}
+	var signed bool
+	if err == nil {
+		var addr smtp.Address
+		if addr, err = smtp.ParseAddress(l[0]); err == nil {
+			buf, signed, err = signMobileConfig(addr.Domain, buf)
+		}
+	}
 	if err != nil {
 		http.Error(w, "400 - bad request - "+err.Error(), http.StatusBadRequest)
 		return
@@ -400,6 +549,9 @@ func mobileconfigHandle(w http.ResponseWriter, r *http.Request) {
 	filename = strings.ReplaceAll(filename, "@", "-at-")
 	filename = "email-account-" + filename + ".mobileconfig"
 	h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if signed {
+		h.Set("Content-Type", "application/x-apple-aspen-config")
+	}
 	_, err = w.Write(buf)
 	log.Check(err, "writing mobileconfig response")
 }
@@ -0,0 +1,185 @@
+package http
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mjl-/mox/admin"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/ratelimit"
+)
+
+// errTooManyUnknownDomainLookups is returned by a render func passed to
+// serveCachedResponse when the source IP has exceeded its budget for looking
+// up domains that turn out not to be hosted here.
+var errTooManyUnknownDomainLookups = errors.New("429 - too many requests - rate limit exceeded for unconfigured-domain lookups")
+
+// autoconfHandle and autodiscoverHandle used to do a live
+// admin.ClientConfigDomain lookup and XML marshal on every request, with the
+// (unbounded) domain taken straight from the request showing up as a
+// Prometheus label. That's an easy cardinality blowup and CPU DoS vector for
+// botnets probing arbitrary hostnames, as seen in community reports of
+// clients hammering these endpoints. We now cache rendered responses for a
+// short while and rate limit lookups for domains we don't actually host.
+
+const autoconfCacheTTL = 5 * time.Minute
+const autoconfCacheMaxEntries = 10_000
+
+type autoconfCacheEntry struct {
+	body []byte
+	etag string
+}
+
+// autoconfCache is a small LRU, keyed on "<kind>:<domain>:<email>" for
+// autoconfig/autodiscover (the rendered body bakes in the email address, so
+// it must be part of the key, or one user's display name/username would leak
+// into another user's cached response on the same domain) and capped at
+// autoconfCacheMaxEntries so a scan across many distinct hostnames/addresses
+// can't grow it without bound.
+type autoconfCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*list.Element // key -> element in order, value *autoconfCacheItem
+	order   *list.List
+}
+
+type autoconfCacheItem struct {
+	key     string
+	entry   autoconfCacheEntry
+	expires time.Time
+}
+
+var autoconfRespCache = &autoconfCache{
+	ttl:     autoconfCacheTTL,
+	entries: map[string]*list.Element{},
+	order:   list.New(),
+}
+
+func (c *autoconfCache) get(key string) (autoconfCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return autoconfCacheEntry{}, false
+	}
+	item := el.Value.(*autoconfCacheItem)
+	if time.Now().After(item.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return autoconfCacheEntry{}, false
+	}
+	c.order.MoveToFront(el)
+	return item.entry, true
+}
+
+func (c *autoconfCache) put(key string, body []byte) autoconfCacheEntry {
+	sum := sha256.Sum256(body)
+	entry := autoconfCacheEntry{body: body, etag: `"` + hex.EncodeToString(sum[:12]) + `"`}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*autoconfCacheItem).entry = entry
+		el.Value.(*autoconfCacheItem).expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(el)
+		return entry
+	}
+
+	for len(c.entries) >= autoconfCacheMaxEntries {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*autoconfCacheItem).key)
+	}
+
+	item := &autoconfCacheItem{key: key, entry: entry, expires: time.Now().Add(c.ttl)}
+	el := c.order.PushFront(item)
+	c.entries[key] = el
+	return entry
+}
+
+// autoconfUnknownDomainLimiter gates lookups for domains we end up not
+// hosting behind a per-source-IP token bucket, reusing mox's existing
+// ratelimit package (also used for submission/webmail login attempts). A
+// legitimate client only ever triggers this for the rare typo; a scanner
+// probing many hostnames runs out of budget quickly.
+var autoconfUnknownDomainLimiter = &ratelimit.Limiter{
+	WindowLimits: []ratelimit.WindowLimit{
+		{Window: time.Minute, Limit: 20},
+		{Window: time.Hour, Limit: 200},
+	},
+}
+
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// allowUnknownDomainLookup reports whether the client is still within budget
+// for looking up domains that turn out to not be hosted here. Call after a
+// (cache-missed) admin.ClientConfigDomain lookup has returned an error.
+func allowUnknownDomainLookup(r *http.Request) bool {
+	ip := clientIP(r)
+	if ip == nil {
+		return true
+	}
+	return autoconfUnknownDomainLimiter.Add(ip, time.Now(), 1)
+}
+
+// metricDomainLabel caps the Prometheus domain label to domains we actually
+// host, plus a catch-all "other" bucket, so probing arbitrary hostnames can't
+// grow the metric's cardinality.
+func metricDomainLabel(domain dns.Domain) string {
+	if domain.ASCII == "" {
+		return "other"
+	}
+	if _, err := admin.ClientConfigDomain(domain); err != nil {
+		return "other"
+	}
+	return domain.ASCII
+}
+
+// serveCachedResponse serves a cached rendering for cacheKey if fresh,
+// otherwise calls render to produce one, both paths honoring
+// If-None-Match/ETag so well-behaved clients get a 304 on repeated boot. A
+// render error other than errTooManyUnknownDomainLookups (e.g. an unknown
+// domain) is turned into a 400 response here; the returned error is only
+// for genuine write failures, which callers log but can't otherwise act on.
+func serveCachedResponse(w http.ResponseWriter, r *http.Request, cacheKey, contentType string, render func() ([]byte, error)) error {
+	entry, ok := autoconfRespCache.get(cacheKey)
+	if !ok {
+		body, err := render()
+		if errors.Is(err, errTooManyUnknownDomainLookups) {
+			http.Error(w, "429 - too many requests - slow down", http.StatusTooManyRequests)
+			return nil
+		}
+		if err != nil {
+			http.Error(w, "400 - bad request - "+err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		entry = autoconfRespCache.put(cacheKey, body)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == entry.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	_, err := w.Write(entry.body)
+	return err
+}
@@ -0,0 +1,90 @@
+package http
+
+import (
+	"container/list"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjl-/mox/admin"
+	"github.com/mjl-/mox/dns"
+)
+
+func TestAutoconfCacheGetPut(t *testing.T) {
+	c := &autoconfCache{ttl: time.Minute, entries: map[string]*list.Element{}, order: list.New()}
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("get on empty cache returned ok")
+	}
+	entry := c.put("a", []byte("hello"))
+	if entry.etag == "" {
+		t.Fatalf("put did not set an etag")
+	}
+	got, ok := c.get("a")
+	if !ok || string(got.body) != "hello" {
+		t.Fatalf("get after put = %v, %v, want hello, true", got, ok)
+	}
+}
+
+func TestAutoconfCacheTTLExpiry(t *testing.T) {
+	c := &autoconfCache{ttl: time.Millisecond, entries: map[string]*list.Element{}, order: list.New()}
+	c.put("a", []byte("hello"))
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Fatalf("expired entry was still served from cache")
+	}
+}
+
+func TestAutoconfCacheLRUEviction(t *testing.T) {
+	c := &autoconfCache{ttl: time.Minute, entries: map[string]*list.Element{}, order: list.New()}
+	for i := 0; i < autoconfCacheMaxEntries+10; i++ {
+		c.put(string(rune(i)), []byte("x"))
+	}
+	if len(c.entries) > autoconfCacheMaxEntries {
+		t.Fatalf("cache grew to %d entries, want at most %d", len(c.entries), autoconfCacheMaxEntries)
+	}
+	if _, ok := c.get(string(rune(0))); ok {
+		t.Fatalf("oldest entry should have been evicted")
+	}
+}
+
+// TestAutoconfKeyedByAddress guards against the cache serving one user's
+// rendered autoconfig response (which bakes in their email address as
+// display name and server usernames) to a different user on the same
+// domain.
+func TestAutoconfKeyedByAddress(t *testing.T) {
+	domain, err := dns.ParseDomain("cachetest.example")
+	if err != nil {
+		t.Fatalf("parsing domain: %v", err)
+	}
+	admin.SetClientConfig(domain, admin.ClientConfig{
+		IMAP:       admin.ServerConfig{Host: domain, Port: 993, TLSMode: admin.TLSModeImmediate},
+		Submission: admin.ServerConfig{Host: domain, Port: 465, TLSMode: admin.TLSModeImmediate},
+	})
+	defer admin.RemoveClientConfig(domain)
+
+	get := func(email string) string {
+		req := httptest.NewRequest("GET", "/mail/config-v1.1.xml?emailaddress="+email, nil)
+		rec := httptest.NewRecorder()
+		autoconfHandle(rec, req)
+		body, err := io.ReadAll(rec.Result().Body)
+		if err != nil {
+			t.Fatalf("reading response body: %v", err)
+		}
+		return string(body)
+	}
+
+	bodyAlice := get("alice@cachetest.example")
+	bodyBob := get("bob@cachetest.example")
+
+	if bodyAlice == bodyBob {
+		t.Fatalf("alice and bob got the identical cached autoconfig response for the same domain")
+	}
+	if !strings.Contains(bodyAlice, "alice@cachetest.example") || strings.Contains(bodyAlice, "bob@cachetest.example") {
+		t.Fatalf("alice's autoconfig response doesn't contain her own address or leaks bob's: %s", bodyAlice)
+	}
+	if !strings.Contains(bodyBob, "bob@cachetest.example") || strings.Contains(bodyBob, "alice@cachetest.example") {
+		t.Fatalf("bob's autoconfig response doesn't contain his own address or leaks alice's: %s", bodyBob)
+	}
+}
@@ -0,0 +1,145 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/mjl-/mox/admin"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/smtp"
+)
+
+var metricAutodiscoverV2 = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mox_autodiscoverv2_request_total",
+		Help: "Number of autodiscover v2 (JSON) requests.",
+	},
+	[]string{"domain", "protocol"},
+)
+
+// Autodiscover v2, the JSON protocol modern Outlook (Windows/Mac/mobile) clients
+// actually use. The POX XML handled by autodiscoverHandle in autoconf.go is mostly
+// ignored by these clients, as noted in its comments and in various Outlook bug
+// reports.
+//
+// User should create a DNS record: _autodiscover._tcp.<domain> SRV 0 0 443 <hostname>
+//
+// Clients request:
+//
+//	GET /autodiscover/autodiscover.json?Email=user@example.org&Protocol=Imap
+//
+// with Protocol one of Imap, Pop, Smtp, Autodiscoverv1, ActiveSync, Caldav,
+// Carddav.
+//
+// See https://learn.microsoft.com/en-us/exchange/client-developer/exchange-web-services/autodiscover-for-exchange
+func autodiscoverV2Handle(w http.ResponseWriter, r *http.Request) {
+	log := pkglog.WithContext(r.Context())
+
+	protocol := r.FormValue("Protocol")
+	var addrDom string
+	defer func() {
+		metricAutodiscoverV2.WithLabelValues(addrDom, protocol).Inc()
+	}()
+
+	if r.Method != "GET" {
+		http.Error(w, "405 - method not allowed - get required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	email := r.FormValue("Email")
+	addr, err := smtp.ParseAddress(email)
+	if err != nil {
+		http.Error(w, "400 - bad request - invalid parameter Email", http.StatusBadRequest)
+		return
+	}
+	log.Debug("autodiscover v2 request", slog.String("email", email), slog.String("protocol", protocol))
+
+	// Autodiscoverv1 asks us to point the client at the legacy POX XML endpoint
+	// instead, no need to look up the domain config for that.
+	if protocol == "Autodiscoverv1" {
+		http.Redirect(w, r, "/autodiscover/autodiscover.xml", http.StatusFound)
+		return
+	}
+
+	addrDom = metricDomainLabel(addr.Domain)
+
+	// Same reasoning as autoconfHandle/autodiscoverHandle: cache rendered
+	// responses, and answer with 429 once a source IP has asked for too many
+	// domains we don't host. The domain config is still looked up on every
+	// request (for the metric label) and on every cache miss; error responses
+	// are not cached. Unlike those endpoints, the response here never bakes in
+	// the requested email address, so domain+protocol is a safe cache key.
+	err = serveCachedResponse(w, r, "autodiscoverv2:"+addr.Domain.ASCII+":"+protocol, "application/json; charset=utf-8", func() ([]byte, error) {
+		return renderAutodiscoverV2(r, addr.Domain, protocol)
+	})
+	log.Check(err, "write autodiscover v2 json response")
+}
+
+// renderAutodiscoverV2 builds the autodiscover v2 JSON body for domain and
+// protocol. Only called on a cache miss; see serveCachedResponse.
+func renderAutodiscoverV2(r *http.Request, domain dns.Domain, protocol string) ([]byte, error) {
+	config, err := admin.ClientConfigDomain(domain)
+	if err != nil {
+		if !allowUnknownDomainLookup(r) {
+			return nil, errTooManyUnknownDomainLookups
+		}
+		return nil, err
+	}
+
+	// An admin can configure a different hostname to redirect autodiscover
+	// clients to, e.g. when mail for this domain is actually served elsewhere.
+	if config.RedirectAddr != "" {
+		resp := struct {
+			Protocol     string
+			RedirectAddr string
+		}{"Redirect", config.RedirectAddr}
+		return json.Marshal(resp)
+	}
+
+	var resp struct {
+		Protocol string
+		Url      string
+	}
+	switch protocol {
+	case "Imap":
+		if config.IMAP.Host.ASCII == "" {
+			return nil, fmt.Errorf("IMAP is not offered for this domain")
+		}
+		resp.Protocol = "IMAP"
+		resp.Url = fmt.Sprintf("https://%s:%d", config.IMAP.Host.ASCII, config.IMAP.Port)
+	case "Pop":
+		if config.POP3.Host.ASCII == "" {
+			return nil, fmt.Errorf("POP3 is not offered for this domain")
+		}
+		resp.Protocol = "POP3"
+		resp.Url = fmt.Sprintf("https://%s:%d", config.POP3.Host.ASCII, config.POP3.Port)
+	case "Smtp":
+		if config.Submission.Host.ASCII == "" {
+			return nil, fmt.Errorf("SMTP submission is not offered for this domain")
+		}
+		resp.Protocol = "SMTP"
+		resp.Url = fmt.Sprintf("https://%s:%d", config.Submission.Host.ASCII, config.Submission.Port)
+	case "Caldav":
+		if config.IMAP.Host.ASCII == "" {
+			return nil, fmt.Errorf("CalDAV is not offered for this domain")
+		}
+		resp.Protocol = "CalDAV"
+		resp.Url = fmt.Sprintf("https://%s/dav/principal/", config.IMAP.Host.ASCII)
+	case "Carddav":
+		if config.IMAP.Host.ASCII == "" {
+			return nil, fmt.Errorf("CardDAV is not offered for this domain")
+		}
+		resp.Protocol = "CardDAV"
+		resp.Url = fmt.Sprintf("https://%s/dav/principal/", config.IMAP.Host.ASCII)
+	case "ActiveSync":
+		return nil, fmt.Errorf("ActiveSync is not offered by this server")
+	default:
+		return nil, fmt.Errorf("unknown protocol %q", protocol)
+	}
+	return json.Marshal(resp)
+}
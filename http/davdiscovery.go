@@ -0,0 +1,138 @@
+package http
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mjl-/mox/admin"
+	"github.com/mjl-/mox/dns"
+	"github.com/mjl-/mox/store"
+)
+
+// RFC 6764 CalDAV/CardDAV bootstrap: clients look up a well-known URL to
+// discover where an account's calendar/addressbook service lives, then
+// PROPFIND it for the current-user-principal. We also honor the
+// "_caldavs._tcp"/"_carddavs._tcp" SRV records, in case they point elsewhere,
+// e.g. when calendar/contacts are hosted separately from mail.
+//
+// See https://www.rfc-editor.org/rfc/rfc6764
+
+func wellKnownCalDAVHandle(w http.ResponseWriter, r *http.Request) {
+	davRedirect(w, r, "caldavs")
+}
+
+func wellKnownCardDAVHandle(w http.ResponseWriter, r *http.Request) {
+	davRedirect(w, r, "carddavs")
+}
+
+// davRedirect resolves the SRV record for service.tcp on the requesting host's
+// domain, if any, and redirects to the DAV principal URL on that host.
+// Without an SRV record, we serve ourselves: redirect to the principal on this
+// same host.
+//
+// The SRV lookup result is cached (same cache as autoconfig/autodiscover), and
+// Host values that don't resolve to a domain we actually host are rate
+// limited the same way a cache-missed autoconfig/autodiscover lookup is:
+// these well-known URLs are exactly the kind of endpoint scanners hit with
+// forged Host headers, and a live DNS lookup per distinct forged Host is
+// unnecessary cost we'd otherwise pay on every request.
+func davRedirect(w http.ResponseWriter, r *http.Request, service string) {
+	log := pkglog.WithContext(r.Context())
+
+	domain, err := dns.ParseDomain(r.Host)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 - bad request - invalid domain: %s", r.Host), http.StatusBadRequest)
+		return
+	}
+
+	requestHost := r.Host
+	entry, ok := autoconfRespCache.get("dav-srv:" + service + ":" + domain.ASCII)
+	if !ok {
+		if _, err := admin.ClientConfigDomain(domain); err != nil {
+			if !allowUnknownDomainLookup(r) {
+				http.Error(w, "429 - too many requests - slow down", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		host := requestHost
+		_, addrs, err := net.DefaultResolver.LookupSRV(r.Context(), service, "tcp", domain.ASCII)
+		if err != nil {
+			log.Debugx("looking up dav srv record, continuing with request host", err, slog.String("service", service))
+		} else if len(addrs) > 0 {
+			host = strings.TrimSuffix(addrs[0].Target, ".")
+		}
+		entry = autoconfRespCache.put("dav-srv:"+service+":"+domain.ASCII, []byte(host))
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("https://%s/dav/principal/", string(entry.body)), http.StatusMovedPermanently)
+}
+
+// davPrincipalHandle answers a PROPFIND for current-user-principal, the entry
+// point CalDAV/CardDAV clients use after following the well-known redirect.
+func davPrincipalHandle(w http.ResponseWriter, r *http.Request) {
+	log := pkglog.WithContext(r.Context())
+
+	if r.Method != "PROPFIND" {
+		http.Error(w, "405 - method not allowed - propfind required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mox"`)
+		http.Error(w, "401 - unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Actually verify the credentials against the account store, the same way
+	// IMAP/submission authenticate a login, instead of trusting whatever
+	// username the client sends.
+	acc, err := store.OpenEmailAuth(log, username, password)
+	if err != nil {
+		log.Debugx("dav principal propfind authentication failed", err, slog.String("username", username))
+		w.Header().Set("WWW-Authenticate", `Basic realm="mox"`)
+		http.Error(w, "401 - unauthorized", http.StatusUnauthorized)
+		return
+	}
+	defer func() {
+		err := acc.Close()
+		log.Check(err, "closing account after dav principal propfind")
+	}()
+
+	// username comes straight from the client's Basic-Auth header and ends up in
+	// an XML href: path-escape it (quoted-string local parts can legally contain
+	// "@", "<", etc., per RFC 5321/5322) and then XML-escape the result, so it
+	// can neither break out of the href element nor produce an invalid path.
+	hrefUser := xmlEscapeString(url.PathEscape(username))
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<multistatus xmlns="DAV:">
+	<response>
+		<href>/dav/principal/</href>
+		<propstat>
+			<prop>
+				<current-user-principal><href>/dav/%s/</href></current-user-principal>
+			</prop>
+			<status>HTTP/1.1 200 OK</status>
+		</propstat>
+	</response>
+</multistatus>
+`, hrefUser)
+	log.Debug("dav principal propfind", slog.String("username", username))
+}
+
+// xmlEscapeString escapes s for use as XML character data.
+func xmlEscapeString(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,196 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/mjl-/mox/admin"
+	"github.com/mjl-/mox/smtp"
+)
+
+// plistDict is a small helper for building Apple property list XML, which
+// alternates <key>...</key> with a typed value element instead of using
+// regular attribute/element nesting, so it doesn't map cleanly onto
+// encoding/xml struct tags.
+type plistDict struct {
+	keys   []string
+	values []any // string, bool, int, []byte, or plistDict/[]plistDict
+}
+
+func (d *plistDict) add(key string, value any) {
+	d.keys = append(d.keys, key)
+	d.values = append(d.values, value)
+}
+
+func plistEscape(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		switch r {
+		case '&':
+			buf.WriteString("&amp;")
+		case '<':
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+func plistWriteValue(buf *bytes.Buffer, indent string, value any) {
+	switch v := value.(type) {
+	case string:
+		fmt.Fprintf(buf, "%s<string>%s</string>\n", indent, plistEscape(v))
+	case bool:
+		if v {
+			fmt.Fprintf(buf, "%s<true/>\n", indent)
+		} else {
+			fmt.Fprintf(buf, "%s<false/>\n", indent)
+		}
+	case int:
+		fmt.Fprintf(buf, "%s<integer>%d</integer>\n", indent, v)
+	case []byte:
+		fmt.Fprintf(buf, "%s<data>\n%s%s\n%s</data>\n", indent, indent+"\t", base64.StdEncoding.EncodeToString(v), indent)
+	case plistDict:
+		plistWriteDict(buf, indent, v)
+	case []plistDict:
+		fmt.Fprintf(buf, "%s<array>\n", indent)
+		for _, e := range v {
+			plistWriteDict(buf, indent+"\t", e)
+		}
+		fmt.Fprintf(buf, "%s</array>\n", indent)
+	default:
+		panic(fmt.Sprintf("plist: unsupported value type %T", v))
+	}
+}
+
+func plistWriteDict(buf *bytes.Buffer, indent string, d plistDict) {
+	fmt.Fprintf(buf, "%s<dict>\n", indent)
+	for i, key := range d.keys {
+		fmt.Fprintf(buf, "%s\t<key>%s</key>\n", indent, plistEscape(key))
+		plistWriteValue(buf, indent+"\t", d.values[i])
+	}
+	fmt.Fprintf(buf, "%s</dict>\n", indent)
+}
+
+// MobileConfig returns a .mobileconfig profile for Apple devices (iOS/macOS)
+// that configures IMAP/SMTP mail accounts for the given addresses, plus a
+// CalDAV and CardDAV account per address so Contacts/Calendar are provisioned
+// from the same profile. fullName is used as the mail account name and as the
+// CalDAV/CardDAV account description.
+func MobileConfig(addresses []string, fullName string) ([]byte, error) {
+	var payloads []plistDict
+
+	for _, a := range addresses {
+		addr, err := smtp.ParseAddress(a)
+		if err != nil {
+			return nil, fmt.Errorf("parsing address %q: %v", a, err)
+		}
+		config, err := admin.ClientConfigDomain(addr.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("looking up client config for %q: %v", a, err)
+		}
+
+		// EmailAuthNone plus a paired com.apple.security.pkcs12 payload is how
+		// Apple profiles say "authenticate with the client certificate in this
+		// profile" instead of a password. EmailAuthCRAMMD5 is used when client-cert
+		// auth is preferred but not required (no certificate is embedded then)
+		// and OAuth2 is not configured; Apple has no concept of
+		// SCRAM-SHA-256 or OAuth2 here, so those fall back to EmailAuthPassword.
+		//
+		// RequireClientCert without ClientCertPKCS12 configured would otherwise
+		// produce a profile with no password and a dangling certificate
+		// reference that can never authenticate, so we fall back to a password
+		// prompt instead in that case.
+		mailAuth := "EmailAuthPassword"
+		if config.Auth.RequireClientCert && len(config.Auth.ClientCertPKCS12) > 0 {
+			mailAuth = "EmailAuthNone"
+		} else if config.Auth.OAuth2 == nil && config.Auth.PreferClientCert {
+			mailAuth = "EmailAuthCRAMMD5"
+		}
+
+		mail := plistDict{}
+		mail.add("PayloadType", "com.apple.mail.managed")
+		mail.add("PayloadVersion", 1)
+		mail.add("PayloadIdentifier", "mail."+a)
+		mail.add("PayloadUUID", "mail-"+a)
+		mail.add("PayloadDisplayName", fmt.Sprintf("%s (%s)", a, fullName))
+		mail.add("EmailAccountName", fullName)
+		mail.add("EmailAccountType", "EmailTypeIMAP")
+		mail.add("EmailAddress", a)
+		mail.add("IncomingMailServerAuthentication", mailAuth)
+		mail.add("IncomingMailServerHostName", config.IMAP.Host.ASCII)
+		mail.add("IncomingMailServerPortNumber", config.IMAP.Port)
+		mail.add("IncomingMailServerUseSSL", true)
+		mail.add("IncomingMailServerUsername", a)
+		mail.add("OutgoingMailServerAuthentication", mailAuth)
+		mail.add("OutgoingMailServerHostName", config.Submission.Host.ASCII)
+		mail.add("OutgoingMailServerPortNumber", config.Submission.Port)
+		mail.add("OutgoingMailServerUseSSL", true)
+		mail.add("OutgoingMailServerUsername", a)
+		mail.add("OutgoingPasswordSameAsIncomingPassword", true)
+		if mailAuth == "EmailAuthNone" {
+			mail.add("IncomingMailServerClientCertificate", "cert-"+a)
+			mail.add("OutgoingMailServerClientCertificate", "cert-"+a)
+		}
+		payloads = append(payloads, mail)
+
+		if mailAuth == "EmailAuthNone" && len(config.Auth.ClientCertPKCS12) > 0 {
+			pkcs12 := plistDict{}
+			pkcs12.add("PayloadType", "com.apple.security.pkcs12")
+			pkcs12.add("PayloadVersion", 1)
+			pkcs12.add("PayloadIdentifier", "cert-"+a)
+			pkcs12.add("PayloadUUID", "cert-"+a)
+			pkcs12.add("PayloadDisplayName", fmt.Sprintf("%s (client certificate)", a))
+			pkcs12.add("PayloadContent", config.Auth.ClientCertPKCS12)
+			payloads = append(payloads, pkcs12)
+		}
+
+		caldav := plistDict{}
+		caldav.add("PayloadType", "com.apple.caldav.account")
+		caldav.add("PayloadVersion", 1)
+		caldav.add("PayloadIdentifier", "caldav."+a)
+		caldav.add("PayloadUUID", "caldav-"+a)
+		caldav.add("PayloadDisplayName", fmt.Sprintf("%s (CalDAV)", a))
+		caldav.add("CalDAVAccountDescription", fullName)
+		caldav.add("CalDAVHostName", config.IMAP.Host.ASCII)
+		caldav.add("CalDAVPort", 443)
+		caldav.add("CalDAVUseSSL", true)
+		caldav.add("CalDAVUsername", a)
+		caldav.add("CalDAVAccountType", "CalDAVAccountTypePrincipal")
+		payloads = append(payloads, caldav)
+
+		carddav := plistDict{}
+		carddav.add("PayloadType", "com.apple.carddav.account")
+		carddav.add("PayloadVersion", 1)
+		carddav.add("PayloadIdentifier", "carddav."+a)
+		carddav.add("PayloadUUID", "carddav-"+a)
+		carddav.add("PayloadDisplayName", fmt.Sprintf("%s (CardDAV)", a))
+		carddav.add("CardDAVAccountDescription", fullName)
+		carddav.add("CardDAVHostName", config.IMAP.Host.ASCII)
+		carddav.add("CardDAVPort", 443)
+		carddav.add("CardDAVUseSSL", true)
+		carddav.add("CardDAVUsername", a)
+		payloads = append(payloads, carddav)
+	}
+
+	top := plistDict{}
+	top.add("PayloadType", "Configuration")
+	top.add("PayloadVersion", 1)
+	top.add("PayloadIdentifier", "mailconfig")
+	top.add("PayloadUUID", "mailconfig")
+	top.add("PayloadDisplayName", fullName)
+	top.add("PayloadContent", payloads)
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	buf.WriteString(`<plist version="1.0">` + "\n")
+	plistWriteDict(&buf, "", top)
+	buf.WriteString(`</plist>` + "\n")
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,46 @@
+package http
+
+import (
+	"fmt"
+
+	"go.mozilla.org/pkcs7"
+
+	"github.com/mjl-/mox/admin"
+	"github.com/mjl-/mox/dns"
+)
+
+// signMobileConfig wraps plist, the output of MobileConfig, in a CMS/PKCS#7
+// signed-data structure using the signer cert+key (and optional intermediate
+// chain) configured for domain, with a SHA-256 digest over the content. This
+// makes iOS/macOS show the profile as "Verified" instead of warning that it is
+// unsigned, a gap in the original unsigned-only implementation.
+//
+// If no signer is configured for domain, plist is returned unchanged and
+// signed is false, so callers can serve the profile unsigned, without the
+// signed-profile content type.
+func signMobileConfig(domain dns.Domain, plist []byte) (out []byte, signed bool, err error) {
+	cert, chain, ok, err := admin.MobileConfigSigner(domain)
+	if err != nil {
+		return nil, false, fmt.Errorf("looking up mobileconfig signer: %v", err)
+	}
+	if !ok {
+		return plist, false, nil
+	}
+
+	sd, err := pkcs7.NewSignedData(plist)
+	if err != nil {
+		return nil, false, fmt.Errorf("preparing signed-data: %v", err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	for _, c := range chain {
+		sd.AddCertificate(c)
+	}
+	if err := sd.AddSigner(cert.Leaf, cert.PrivateKey, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, false, fmt.Errorf("adding signer: %v", err)
+	}
+	out, err = sd.Finish()
+	if err != nil {
+		return nil, false, fmt.Errorf("finishing signed-data: %v", err)
+	}
+	return out, true, nil
+}